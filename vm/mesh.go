@@ -0,0 +1,243 @@
+package vm
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// A grid of probed Z offsets at (x,y) points, used for bed-leveling compensation of a
+// toolpath over a non-flat surface (e.g. warped copper-clad stock). Grid rows/columns
+// don't need to be evenly spaced - offsetAt locates the enclosing cell by scanning the
+// sorted axis coordinates.
+type Mesh struct {
+	xs []float64   // sorted, unique probed X coordinates
+	ys []float64   // sorted, unique probed Y coordinates
+	z  [][]float64 // z[i][j] is the probed offset at (xs[i], ys[j])
+}
+
+// Builds a Mesh from probed grid coordinates and offsets. Returns an error if z isn't
+// shaped len(xs) x len(ys), or if xs/ys aren't strictly increasing.
+func NewMesh(xs, ys []float64, z [][]float64) (*Mesh, error) {
+	if len(xs) < 2 || len(ys) < 2 {
+		return nil, errors.New("mesh requires at least a 2x2 grid of probe points")
+	}
+	if len(z) != len(xs) {
+		return nil, errors.New("mesh z rows don't match number of x coordinates")
+	}
+	for i, row := range z {
+		if len(row) != len(ys) {
+			return nil, errors.New("mesh z columns don't match number of y coordinates")
+		}
+		if i > 0 && xs[i] <= xs[i-1] {
+			return nil, errors.New("mesh x coordinates must be strictly increasing")
+		}
+	}
+	for i := 1; i < len(ys); i++ {
+		if ys[i] <= ys[i-1] {
+			return nil, errors.New("mesh y coordinates must be strictly increasing")
+		}
+	}
+	return &Mesh{xs: xs, ys: ys, z: z}, nil
+}
+
+// Reads a probe mesh from CSV rows of "x,y,z", one probe point per row. Points are
+// grouped onto a grid by their distinct x and y values, so the CSV may list points in
+// any order as long as it fully covers the resulting grid.
+func LoadMeshFromProbeCSV(r io.Reader) (*Mesh, error) {
+	reader := csv.NewReader(r)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	type probe struct{ x, y, z float64 }
+	probes := make([]probe, 0, len(records))
+	xset := make(map[float64]bool)
+	yset := make(map[float64]bool)
+
+	for _, rec := range records {
+		if len(rec) != 3 {
+			return nil, errors.New("probe CSV rows must have exactly 3 columns: x,y,z")
+		}
+		x, err := strconv.ParseFloat(rec[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		y, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		z, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return nil, err
+		}
+		probes = append(probes, probe{x, y, z})
+		xset[x], yset[y] = true, true
+	}
+
+	xs := sortedKeys(xset)
+	ys := sortedKeys(yset)
+
+	z := make([][]float64, len(xs))
+	for i := range z {
+		z[i] = make([]float64, len(ys))
+	}
+
+	xIdx := indexOf(xs)
+	yIdx := indexOf(ys)
+	for _, p := range probes {
+		z[xIdx[p.x]][yIdx[p.y]] = p.z
+	}
+
+	return NewMesh(xs, ys, z)
+}
+
+func sortedKeys(set map[float64]bool) []float64 {
+	keys := make([]float64, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	return keys
+}
+
+func indexOf(values []float64) map[float64]int {
+	idx := make(map[float64]int, len(values))
+	for i, v := range values {
+		idx[v] = i
+	}
+	return idx
+}
+
+// Returns the mesh's XY bounding box.
+func (m *Mesh) bounds() (minX, maxX, minY, maxY float64) {
+	return m.xs[0], m.xs[len(m.xs)-1], m.ys[0], m.ys[len(m.ys)-1]
+}
+
+// Bilinearly interpolates the probed Z offset at (x,y). Points outside the mesh are
+// clamped to the nearest edge cell.
+func (m *Mesh) offsetAt(x, y float64) float64 {
+	xi := cellIndex(m.xs, x)
+	yi := cellIndex(m.ys, y)
+
+	x0, x1 := m.xs[xi], m.xs[xi+1]
+	y0, y1 := m.ys[yi], m.ys[yi+1]
+
+	tx := (x - x0) / (x1 - x0)
+	ty := (y - y0) / (y1 - y0)
+	tx = math.Min(1, math.Max(0, tx))
+	ty = math.Min(1, math.Max(0, ty))
+
+	z00, z10 := m.z[xi][yi], m.z[xi+1][yi]
+	z01, z11 := m.z[xi][yi+1], m.z[xi+1][yi+1]
+
+	z0 := z00*(1-tx) + z10*tx
+	z1 := z01*(1-tx) + z11*tx
+	return z0*(1-ty) + z1*ty
+}
+
+// Finds the index i such that values[i] <= v <= values[i+1], clamping to the first/last
+// cell when v falls outside the covered range.
+func cellIndex(values []float64, v float64) int {
+	if v <= values[0] {
+		return 0
+	}
+	if v >= values[len(values)-1] {
+		return len(values) - 2
+	}
+	i := sort.SearchFloat64s(values, v)
+	if i > 0 && values[i] != v {
+		i--
+	}
+	if i >= len(values)-1 {
+		i = len(values) - 2
+	}
+	return i
+}
+
+// Walks posStack and offsets Z at each move by the bilinearly interpolated mesh value
+// at (x,y). Linear moves that span multiple mesh cells are subdivided at cell
+// boundaries so the compensated path tracks the warped surface instead of tilting
+// linearly between endpoints; rapid moves are compensated at their endpoint only.
+// Returns an error if the mesh's XY extent doesn't cover the toolpath's bounding box.
+func (vm *Machine) ApplyMeshLeveling(m *Mesh) error {
+	minX, maxX, minY, maxY := vm.boundingBoxXY()
+	meshMinX, meshMaxX, meshMinY, meshMaxY := m.bounds()
+	if minX < meshMinX || maxX > meshMaxX || minY < meshMinY || maxY > meshMaxY {
+		return errors.New("mesh XY extent doesn't cover the toolpath bounding box")
+	}
+
+	npos := make([]Position, 0, len(vm.posStack))
+	var lastx, lasty float64
+
+	for _, p := range vm.posStack {
+		if p.state.moveMode == moveModeLinear {
+			for _, sub := range subdivideAtMeshBoundaries(m, lastx, lasty, p.x, p.y) {
+				leveled := p
+				leveled.x, leveled.y = sub.x, sub.y
+				leveled.z = p.z + m.offsetAt(sub.x, sub.y)
+				npos = append(npos, leveled)
+			}
+		} else {
+			leveled := p
+			leveled.z = p.z + m.offsetAt(p.x, p.y)
+			npos = append(npos, leveled)
+		}
+		lastx, lasty = p.x, p.y
+	}
+
+	vm.posStack = npos
+	return nil
+}
+
+// Returns the XY bounding box of every move in posStack.
+func (vm *Machine) boundingBoxXY() (minX, maxX, minY, maxY float64) {
+	for i, p := range vm.posStack {
+		if i == 0 || p.x < minX {
+			minX = p.x
+		}
+		if i == 0 || p.x > maxX {
+			maxX = p.x
+		}
+		if i == 0 || p.y < minY {
+			minY = p.y
+		}
+		if i == 0 || p.y > maxY {
+			maxY = p.y
+		}
+	}
+	return
+}
+
+type xy struct{ x, y float64 }
+
+// Splits the segment (x0,y0)-(x1,y1) at every mesh grid line it crosses, returning the
+// intermediate points followed by the endpoint.
+func subdivideAtMeshBoundaries(m *Mesh, x0, y0, x1, y1 float64) []xy {
+	ts := []float64{}
+	addCrossings := func(v0, v1 float64, grid []float64) {
+		if v0 == v1 {
+			return
+		}
+		for _, g := range grid {
+			t := (g - v0) / (v1 - v0)
+			if t > 0 && t < 1 {
+				ts = append(ts, t)
+			}
+		}
+	}
+	addCrossings(x0, x1, m.xs)
+	addCrossings(y0, y1, m.ys)
+	sort.Float64s(ts)
+
+	points := make([]xy, 0, len(ts)+1)
+	for _, t := range ts {
+		points = append(points, xy{x0 + t*(x1-x0), y0 + t*(y1-y0)})
+	}
+	points = append(points, xy{x1, y1})
+	return points
+}
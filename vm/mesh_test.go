@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMeshOffsetAtInterpolatesBilinearly(t *testing.T) {
+	m, err := NewMesh(
+		[]float64{0, 10},
+		[]float64{0, 10},
+		[][]float64{{0, 2}, {4, 6}},
+	)
+	if err != nil {
+		t.Fatalf("NewMesh returned an error: %v", err)
+	}
+
+	if got := m.offsetAt(5, 5); math.Abs(got-3) > 1e-9 {
+		t.Fatalf("expected the center offset to be the average of the 4 corners (3), got %v", got)
+	}
+	if got := m.offsetAt(-5, -5); math.Abs(got-0) > 1e-9 {
+		t.Fatalf("expected out-of-range coordinates to clamp to the nearest edge cell, got %v", got)
+	}
+}
+
+func TestSubdivideAtMeshBoundariesSplitsAtGridLines(t *testing.T) {
+	m, err := NewMesh(
+		[]float64{0, 10, 20},
+		[]float64{0, 10},
+		[][]float64{{0, 0}, {0, 5}, {0, 0}},
+	)
+	if err != nil {
+		t.Fatalf("NewMesh returned an error: %v", err)
+	}
+
+	points := subdivideAtMeshBoundaries(m, 0, 10, 20, 10)
+
+	if len(points) != 2 {
+		t.Fatalf("expected the move to split at the single x=10 grid line into 2 points, got %d: %+v", len(points), points)
+	}
+	if points[0].x != 10 || points[0].y != 10 {
+		t.Fatalf("expected the first split point at the x=10 grid boundary, got %+v", points[0])
+	}
+	if points[1].x != 20 || points[1].y != 10 {
+		t.Fatalf("expected the final point at the move's endpoint, got %+v", points[1])
+	}
+}
+
+func TestApplyMeshLevelingSubdividesMultiCellMoveAtBoundaries(t *testing.T) {
+	// z peaks to 5 only at (x=10, y=10) - a move tilting linearly between its
+	// endpoints' offsets (0 at x=0, 0 at x=20) would flatten straight through the
+	// peak. Subdividing at the x=10 grid line forces a waypoint there that samples
+	// the peak directly, tracking the warped surface instead of averaging over it.
+	m, err := NewMesh(
+		[]float64{0, 10, 20},
+		[]float64{0, 10},
+		[][]float64{{0, 0}, {0, 5}, {0, 0}},
+	)
+	if err != nil {
+		t.Fatalf("NewMesh returned an error: %v", err)
+	}
+
+	vm := &Machine{posStack: []Position{
+		{x: 0, y: 10, z: 0, state: state{moveMode: moveModeRapid}},
+		{x: 20, y: 10, z: 0, state: state{moveMode: moveModeLinear}},
+	}}
+	if err := vm.ApplyMeshLeveling(m); err != nil {
+		t.Fatalf("ApplyMeshLeveling returned an error: %v", err)
+	}
+
+	if len(vm.posStack) != 3 {
+		t.Fatalf("expected the rapid plus 2 subdivided linear segments, got %d: %+v", len(vm.posStack), vm.posStack)
+	}
+
+	mid, end := vm.posStack[1], vm.posStack[2]
+	if mid.x != 10 || mid.y != 10 || math.Abs(mid.z-5) > 1e-9 {
+		t.Fatalf("expected the boundary waypoint at (10,10) to carry the peak offset 5, got %+v", mid)
+	}
+	if end.x != 20 || end.y != 10 || math.Abs(end.z-0) > 1e-9 {
+		t.Fatalf("expected the endpoint at (20,10) to carry its own offset 0, got %+v", end)
+	}
+}
+
+func TestApplyMeshLevelingOffsetsZAndRejectsOutOfBounds(t *testing.T) {
+	m, err := NewMesh(
+		[]float64{0, 10},
+		[]float64{0, 10},
+		[][]float64{{1, 1}, {1, 1}},
+	)
+	if err != nil {
+		t.Fatalf("NewMesh returned an error: %v", err)
+	}
+
+	vm := &Machine{posStack: []Position{
+		{x: 0, y: 0, z: 0, state: state{moveMode: moveModeRapid}},
+	}}
+	if err := vm.ApplyMeshLeveling(m); err != nil {
+		t.Fatalf("ApplyMeshLeveling returned an error: %v", err)
+	}
+	if got := vm.posStack[0].z; math.Abs(got-1) > 1e-9 {
+		t.Fatalf("expected the move's z to be offset by the mesh's uniform 1.0 probe value, got %v", got)
+	}
+
+	outOfBounds := &Machine{posStack: []Position{
+		{x: 20, y: 20, z: 0, state: state{moveMode: moveModeRapid}},
+	}}
+	if err := outOfBounds.ApplyMeshLeveling(m); err == nil {
+		t.Fatal("expected an error when the toolpath extends beyond the mesh's XY extent")
+	}
+}
@@ -13,6 +13,13 @@ import "fmt"
 //      less than a certain minimum angle
 //
 
+// Reports whether m is a linear Z-descent move at the same (x,y) as the previous
+// position - the drill-plunge detection shared by OptDrillSpeed, ExpandPeckDrilling
+// and MergeTools' plunge-feedrate handling.
+func isDescentMove(m Position, lastx, lasty, lastz float64) bool {
+	return m.x == lastx && m.y == lasty && m.z < lastz && m.state.moveMode == moveModeLinear
+}
+
 // Detects a previous drill, and uses rapid move to the previous known depth
 // Scans through all Z-descent moves, logs its height, and ensures that any future move
 // at that location will use moveModeRapid to go to the deepest previous known Z-height.
@@ -53,7 +60,7 @@ func (vm *Machine) OptDrillSpeed() {
 	}
 
 	for _, m := range vm.posStack {
-		if m.x == lastx && m.y == lasty && m.z < lastz && m.state.moveMode == moveModeLinear {
+		if isDescentMove(m, lastx, lasty, lastz) {
 			posn, poso, shouldinsert := fastDrill(m)
 			if shouldinsert {
 				npos = append(npos, posn)
@@ -67,31 +74,22 @@ func (vm *Machine) OptDrillSpeed() {
 	vm.posStack = npos
 }
 
-// Reduces moves between routing operations.
-// Scans through position stack, grouping moves that move from >= Z0 to < Z0.
-// These moves are then sorted after closest to previous position, starting at X0 Y0,
-// and moves to groups recalculated as they are inserted in a new stack.
-// This optimization pass bails if the Z axis is moved simultaneously with any other axis,
-// or the input ends with the drill below Z0, in order to play it safe.
-// This pass is new, and therefore slightly experimental.
-func (vm *Machine) OptRouteGrouping() (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
-		}
-	}()
+// A contiguous group of moves belonging to a single drill/route operation, as detected
+// by extractSets.
+type Set []Position
 
-	type Set []Position
+// Scans through the position stack, grouping moves that move from >= Z0 to < Z0.
+// Returns the detected sets along with the safety height and drill feedrate they were
+// derived under. Panics (via the caller's recover) on anything that doesn't match the
+// simple single-tool, no-simultaneous-axis assumptions the route-grouping passes rely on.
+func (vm *Machine) extractSets() (sets []Set, safetyHeight, drillSpeed float64) {
 	var (
 		lastx, lasty, lastz float64
-		sets                []Set = make([]Set, 0)
-		curSet              Set   = make(Set, 0)
-		safetyHeight        float64
-		drillSpeed          float64
+		curSet              Set  = make(Set, 0)
 		sequenceStarted     bool = false
 	)
+	sets = make([]Set, 0)
 
-	// Find grouped drills
 	for _, m := range vm.posStack {
 		if m.z != lastz && (m.x != lastx || m.y != lasty) {
 			panic("Complex z-motion detected")
@@ -148,40 +146,13 @@ func (vm *Machine) OptRouteGrouping() (err error) {
 		panic("Incomplete final drill set")
 	}
 
-	var (
-		curX, curY, curZ float64 = 0, 0, 0
-		sortedSets       []Set   = make([]Set, 0)
-		selectedSet      int
-	)
-
-	// Stupid difference calculator
-	diffFromCur := func(pos Position) float64 {
-		x := math.Max(curX, pos.x) - math.Min(curX, pos.x)
-		y := math.Max(curY, pos.y) - math.Min(curY, pos.y)
-		z := math.Max(curZ, pos.z) - math.Min(curZ, pos.z)
-		return math.Sqrt(math.Pow(x, 2) + math.Pow(y, 2) + math.Pow(z, 2))
-	}
-
-	// Sort the sets after distance from current position
-	for len(sets) > 0 {
-		for idx, _ := range sets {
-			if selectedSet == -1 {
-				selectedSet = idx
-			} else {
-				diff := diffFromCur(sets[idx][0])
-				other := diffFromCur(sets[selectedSet][0])
-				if diff < other {
-					selectedSet = idx
-				}
-			}
-		}
-		curX, curY, curZ = sets[selectedSet][0].x, sets[selectedSet][0].y, sets[selectedSet][0].z
-		sortedSets = append(sortedSets, sets[selectedSet])
-		sets = append(sets[0:selectedSet], sets[selectedSet+1:]...)
-		selectedSet = -1
-	}
+	return sets, safetyHeight, drillSpeed
+}
 
-	// Reconstruct new position stack from sorted sections
+// Rebuilds a position stack from an ordered slice of sets, inserting safety-height
+// travel moves between sets as needed. Shared by OptRouteGrouping and its 2-opt/SA
+// follow-up passes so they all reconstruct the stack identically.
+func (vm *Machine) reconstructFromSets(sets []Set, safetyHeight, drillSpeed float64) []Position {
 	newPos := make([]Position, 0)
 	newPos = append(newPos, vm.posStack[0]) // The first null-move
 
@@ -226,7 +197,7 @@ func (vm *Machine) OptRouteGrouping() (err error) {
 
 	}
 
-	for _, m := range sortedSets {
+	for _, m := range sets {
 		for idx, p := range m {
 			if idx == 0 {
 				moveTo(p)
@@ -236,11 +207,225 @@ func (vm *Machine) OptRouteGrouping() (err error) {
 		}
 	}
 
-	vm.posStack = newPos
+	return newPos
+}
+
+// Reduces moves between routing operations.
+// Scans through position stack, grouping moves that move from >= Z0 to < Z0.
+// These moves are then sorted after closest to previous position, starting at X0 Y0,
+// and moves to groups recalculated as they are inserted in a new stack.
+// This optimization pass bails if the Z axis is moved simultaneously with any other axis,
+// or the input ends with the drill below Z0, in order to play it safe.
+// This pass is new, and therefore slightly experimental.
+func (vm *Machine) OptRouteGrouping() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	sets, safetyHeight, drillSpeed := vm.extractSets()
+
+	var (
+		curX, curY, curZ float64 = 0, 0, 0
+		sortedSets       []Set   = make([]Set, 0)
+		selectedSet      int
+	)
+
+	// Stupid difference calculator
+	diffFromCur := func(pos Position) float64 {
+		x := math.Max(curX, pos.x) - math.Min(curX, pos.x)
+		y := math.Max(curY, pos.y) - math.Min(curY, pos.y)
+		z := math.Max(curZ, pos.z) - math.Min(curZ, pos.z)
+		return math.Sqrt(math.Pow(x, 2) + math.Pow(y, 2) + math.Pow(z, 2))
+	}
+
+	// Sort the sets after distance from current position
+	for len(sets) > 0 {
+		for idx, _ := range sets {
+			if selectedSet == -1 {
+				selectedSet = idx
+			} else {
+				diff := diffFromCur(sets[idx][0])
+				other := diffFromCur(sets[selectedSet][0])
+				if diff < other {
+					selectedSet = idx
+				}
+			}
+		}
+		curX, curY, curZ = sets[selectedSet][0].x, sets[selectedSet][0].y, sets[selectedSet][0].z
+		sortedSets = append(sortedSets, sets[selectedSet])
+		sets = append(sets[0:selectedSet], sets[selectedSet+1:]...)
+		selectedSet = -1
+	}
+
+	vm.posStack = vm.reconstructFromSets(sortedSets, safetyHeight, drillSpeed)
 
 	return nil
 }
 
+// Travel distance between two sets' entry points, X0Y0 being the fixed tour start.
+func setDistance(a, b Set) float64 {
+	x := math.Max(a[0].x, b[0].x) - math.Min(a[0].x, b[0].x)
+	y := math.Max(a[0].y, b[0].y) - math.Min(a[0].y, b[0].y)
+	z := math.Max(a[0].z, b[0].z) - math.Min(a[0].z, b[0].z)
+	return math.Sqrt(math.Pow(x, 2) + math.Pow(y, 2) + math.Pow(z, 2))
+}
+
+// Total travel distance of a tour of sets, starting from X0Y0.
+func tourLength(sets []Set) float64 {
+	origin := Set{Position{}}
+	total := setDistance(origin, sets[0])
+	for i := 1; i < len(sets); i++ {
+		total += setDistance(sets[i-1], sets[i])
+	}
+	return total
+}
+
+// Runs a 2-opt improvement pass on top of OptRouteGrouping's nearest-neighbor ordering.
+// Repeatedly scans all pairs (i,j) with i<j and reverses the subsequence between them
+// whenever doing so reduces total travel, iterating until a full pass yields no
+// improvement or iterations passes have been made, whichever comes first.
+func (vm *Machine) OptRouteGrouping2Opt(iterations int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	sets, safetyHeight, drillSpeed := vm.extractSets()
+	if len(sets) < 2 {
+		// Nothing meaningful for 2-opt to improve.
+		return nil
+	}
+
+	vm.posStack = vm.reconstructFromSets(twoOptOrder(sets, iterations), safetyHeight, drillSpeed)
+
+	return nil
+}
+
+// Repeatedly scans all pairs (i,j) with i<j and reverses the subsequence between them
+// whenever doing so reduces total travel, iterating until a full pass yields no
+// improvement or iterations passes have been made, whichever comes first.
+func twoOptOrder(sets []Set, iterations int) []Set {
+	for pass := 0; pass < iterations; pass++ {
+		improved := false
+		for i := 0; i < len(sets)-1; i++ {
+			for j := i + 1; j < len(sets); j++ {
+				reversed := reverseSetRange(sets, i, j)
+				if tourLength(reversed) < tourLength(sets) {
+					sets = reversed
+					improved = true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return sets
+}
+
+// Returns a copy of sets with the [i,j] subsequence reversed.
+func reverseSetRange(sets []Set, i, j int) []Set {
+	out := make([]Set, len(sets))
+	copy(out, sets)
+	for lo, hi := i, j; lo < hi; lo, hi = lo+1, hi-1 {
+		out[lo], out[hi] = out[hi], out[lo]
+	}
+	return out
+}
+
+// Configures the simulated-annealing route-order search.
+type AnnealConfig struct {
+	Iterations  int     // number of candidate swaps to try
+	InitialTemp float64 // starting temperature
+	CoolingRate float64 // multiplicative cooling factor applied per iteration, e.g. 0.995
+}
+
+// Runs a simulated-annealing improvement pass on top of OptRouteGrouping's ordering.
+// At each iteration, a random subsequence of sets is reversed (a 2-opt move); the move
+// is always kept if it improves total travel, and otherwise kept with probability
+// exp(-delta/T). The temperature is cooled geometrically (T <- cfg.CoolingRate * T)
+// after every iteration, letting the search escape local minima that plain 2-opt gets
+// stuck in on larger jobs. The best tour seen over the whole run - not just wherever
+// the search happens to end up - is what gets applied to posStack.
+func (vm *Machine) OptRouteGroupingSA(cfg AnnealConfig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%s", r))
+		}
+	}()
+
+	sets, safetyHeight, drillSpeed := vm.extractSets()
+	if len(sets) < 4 {
+		return nil
+	}
+
+	vm.posStack = vm.reconstructFromSets(simulatedAnnealingOrder(sets, cfg, newLCG(1)), safetyHeight, drillSpeed)
+
+	return nil
+}
+
+// Runs the simulated-annealing search described by OptRouteGroupingSA over sets,
+// returning the best tour found - not just wherever the search happens to end up,
+// since accepted worsening moves mean the two can differ.
+func simulatedAnnealingOrder(sets []Set, cfg AnnealConfig, rng *lcg) []Set {
+	temp := cfg.InitialTemp
+	current := tourLength(sets)
+	best := sets
+	bestLen := current
+
+	for iter := 0; iter < cfg.Iterations; iter++ {
+		i := int(rng.next() % uint64(len(sets)))
+		j := int(rng.next() % uint64(len(sets)))
+		if i == j {
+			temp *= cfg.CoolingRate
+			continue
+		}
+		if i > j {
+			i, j = j, i
+		}
+
+		candidate := reverseSetRange(sets, i, j)
+		candidateLen := tourLength(candidate)
+		delta := candidateLen - current
+
+		if delta < 0 || math.Exp(-delta/temp) > rng.nextFloat() {
+			sets = candidate
+			current = candidateLen
+
+			if current < bestLen {
+				best = sets
+				bestLen = current
+			}
+		}
+
+		temp *= cfg.CoolingRate
+	}
+
+	return best
+}
+
+// Minimal linear congruential generator, used so OptRouteGroupingSA has no dependency
+// on math/rand's global seed state and stays deterministic across runs.
+type lcg struct {
+	state uint64
+}
+
+func newLCG(seed uint64) *lcg {
+	return &lcg{state: seed}
+}
+
+func (l *lcg) next() uint64 {
+	l.state = l.state*6364136223846793005 + 1442695040888963407
+	return l.state
+}
+
+func (l *lcg) nextFloat() float64 {
+	return float64(l.next()%1000000) / 1000000
+}
+
 // Uses rapid move for all Z-up only moves.
 // Scans all positions for moves that only change the z-axis in a positive direction,
 // and sets the moveMode to moveModeRapid.
@@ -256,12 +441,15 @@ func (vm *Machine) OptLiftSpeed() {
 }
 
 // Kills redundant partial moves.
-// Calculates the unit-vector, and kills all incremental moves between A and B.
-func (vm *Machine) OptBogusMoves() {
+// Calculates the unit-vector, and kills all incremental moves between A and B whose
+// direction hasn't changed by more than epsilon, measured as 1-dot(prevVec, curVec).
+// Passing epsilon=0 restores the old exactly-equal-vector behaviour.
+func (vm *Machine) OptBogusMoves(epsilon float64) {
 	var (
 		xstate, ystate, zstate       float64
 		vecX, vecY, vecZ             float64
 		lastvecX, lastvecY, lastvecZ float64
+		haveLastVec                  bool
 		npos                         []Position = make([]Position, 0)
 	)
 
@@ -270,8 +458,11 @@ func (vm *Machine) OptBogusMoves() {
 		xstate, ystate, zstate = m.x, m.y, m.z
 
 		if m.state.moveMode != moveModeRapid && m.state.moveMode != moveModeLinear {
-			// I'm not mentally ready for arc optimization yet...
+			// Arcs pass through untouched - see OptArcs for arc-aware handling.
+			// The direction they leave us facing is unknown, so the next linear
+			// move must never merge against whatever direction preceded the arc.
 			npos = append(npos, m)
+			haveLastVec = false
 			continue
 		}
 
@@ -283,22 +474,198 @@ func (vm *Machine) OptBogusMoves() {
 		norm := math.Sqrt(math.Pow(dx, 2) + math.Pow(dy, 2) + math.Pow(dz, 2))
 		vecX, vecY, vecZ = dx/norm, dy/norm, dz/norm
 
-		if lastvecX == vecX && lastvecY == vecY && lastvecZ == vecZ {
+		dot := vecX*lastvecX + vecY*lastvecY + vecZ*lastvecZ
+		if haveLastVec && (1-dot < epsilon || (vecX == lastvecX && vecY == lastvecY && vecZ == lastvecZ)) {
 			npos[len(npos)-1] = m
 		} else {
 			npos = append(npos, m)
 			lastvecX, lastvecY, lastvecZ = vecX, vecY, vecZ
+			haveLastVec = true
+		}
+	}
+	vm.posStack = npos
+}
+
+// Detects runs of >=3 colinear-free linear moves whose endpoints lie on a common circle
+// (within epsilon) and replaces them with a single G2/G3 arc move.
+// Circles are fit with a least-squares Kasa fit: solving A*[a,b,c] = -(x^2+y^2) for the
+// points in the candidate run gives a center of (-a/2, -b/2) and a radius of
+// sqrt((a^2+b^2)/4 - c). The winding direction (CW vs CCW) is taken from the sign of the
+// cross product of the first two chord vectors in the run.
+func (vm *Machine) OptArcs(epsilon float64) {
+	var npos []Position = make([]Position, 0)
+
+	isLinear := func(p Position) bool {
+		return p.state.moveMode == moveModeLinear
+	}
+
+	i := 0
+	for i < len(vm.posStack) {
+		m := vm.posStack[i]
+		if !isLinear(m) {
+			npos = append(npos, m)
+			i++
+			continue
+		}
+
+		// A run needs the point before the first linear move as its starting point,
+		// plus the run itself, in order to fit a circle through >=3 points.
+		run := []Position{}
+		if len(npos) > 0 {
+			run = append(run, npos[len(npos)-1])
+		}
+		j := i
+		for j < len(vm.posStack) && isLinear(vm.posStack[j]) {
+			run = append(run, vm.posStack[j])
+			j++
 		}
+
+		if len(run) < 4 { // need >=3 linear moves plus the point they start from
+			npos = append(npos, m)
+			i++
+			continue
+		}
+
+		cx, cy, r, ok := kasaFit(run)
+		if !ok || !cocircular(run, cx, cy, r, epsilon) || !monotonicAngles(run, cx, cy) {
+			npos = append(npos, m)
+			i++
+			continue
+		}
+
+		clockwise := arcWinding(run, cx, cy)
+		last := run[len(run)-1]
+		arc := last
+		arc.i = cx - run[0].x
+		arc.j = cy - run[0].y
+		if clockwise {
+			arc.state.moveMode = moveModeCWArc
+		} else {
+			arc.state.moveMode = moveModeCCWArc
+		}
+
+		npos = append(npos, arc)
+		i = j
 	}
 	vm.posStack = npos
 }
 
+// Solves the least-squares Kasa circle fit for the given points, returning the fitted
+// center and radius. ok is false if the points are (near) colinear and no stable circle
+// can be derived.
+func kasaFit(points []Position) (cx, cy, r float64, ok bool) {
+	n := float64(len(points))
+	var sx, sy, sxx, syy, sxy, sxz, syz, sz float64
+	for _, p := range points {
+		z := p.x*p.x + p.y*p.y
+		sx += p.x
+		sy += p.y
+		sxx += p.x * p.x
+		syy += p.y * p.y
+		sxy += p.x * p.y
+		sxz += p.x * z
+		syz += p.y * z
+		sz += z
+	}
+
+	// Normal equations for A*[a,b,c] = -(x^2+y^2), solved via Cramer's rule.
+	m11, m12, m13 := sxx, sxy, sx
+	m21, m22, m23 := sxy, syy, sy
+	m31, m32, m33 := sx, sy, n
+
+	det := m11*(m22*m33-m23*m32) - m12*(m21*m33-m23*m31) + m13*(m21*m32-m22*m31)
+	if math.Abs(det) < 1e-9 {
+		return 0, 0, 0, false
+	}
+
+	b1, b2, b3 := -sxz, -syz, -sz
+
+	detA := b1*(m22*m33-m23*m32) - m12*(b2*m33-m23*b3) + m13*(b2*m32-m22*b3)
+	detB := m11*(b2*m33-m23*b3) - b1*(m21*m33-m23*m31) + m13*(m21*b3-b2*m31)
+	detC := m11*(m22*b3-b2*m32) - m12*(m21*b3-b2*m31) + b1*(m21*m32-m22*m31)
+
+	a, b, c := detA/det, detB/det, detC/det
+
+	radiusSq := (a*a+b*b)/4 - c
+	if radiusSq <= 0 {
+		return 0, 0, 0, false
+	}
+
+	return -a / 2, -b / 2, math.Sqrt(radiusSq), true
+}
+
+// Checks that every point in the run lies within epsilon of the given circle.
+func cocircular(points []Position, cx, cy, r, epsilon float64) bool {
+	for _, p := range points {
+		d := math.Sqrt(math.Pow(p.x-cx, 2)+math.Pow(p.y-cy, 2)) - r
+		if math.Abs(d) > epsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks that the run progresses monotonically around the fitted circle, i.e. its
+// angle relative to the center never reverses direction. This rejects a run of points
+// that happen to be cocircular but don't trace a consistent arc (e.g. a back-and-forth
+// path that coincidentally sits on a common circle), which would otherwise get
+// collapsed into a single G2/G3 arc that cuts a different path than the original moves.
+func monotonicAngles(points []Position, cx, cy float64) bool {
+	angles := make([]float64, len(points))
+	for i, p := range points {
+		angles[i] = math.Atan2(p.y-cy, p.x-cx)
+	}
+
+	// Unwrap so consecutive angles differ by less than pi, removing the +/-2pi jumps
+	// that atan2's [-pi,pi] range introduces when a run crosses the branch cut.
+	for i := 1; i < len(angles); i++ {
+		for angles[i]-angles[i-1] > math.Pi {
+			angles[i] -= 2 * math.Pi
+		}
+		for angles[i]-angles[i-1] < -math.Pi {
+			angles[i] += 2 * math.Pi
+		}
+	}
+
+	sign := 0.0
+	for i := 1; i < len(angles); i++ {
+		d := angles[i] - angles[i-1]
+		if d == 0 {
+			continue
+		}
+		if sign == 0 {
+			sign = math.Copysign(1, d)
+		} else if math.Copysign(1, d) != sign {
+			return false
+		}
+	}
+	return true
+}
+
+// Determines winding direction from the cross product of the first two chords in the run.
+// Returns true for clockwise, false for counter-clockwise.
+func arcWinding(points []Position, cx, cy float64) bool {
+	v1x, v1y := points[1].x-points[0].x, points[1].y-points[0].y
+	v2x, v2y := points[2].x-points[1].x, points[2].y-points[1].y
+	cross := v1x*v2y - v1y*v2x
+	return cross < 0
+}
+
 // Limit feedrate.
 func (vm *Machine) LimitFeedrate(feed float64) {
 	for idx, m := range vm.posStack {
 		if m.state.feedrate > feed {
 			vm.posStack[idx].state.feedrate = feed
 		}
+		if m.state.entryFeedrate > feed {
+			vm.posStack[idx].state.entryFeedrate = feed
+		}
+		if m.state.cruiseFeedrate > feed {
+			vm.posStack[idx].state.cruiseFeedrate = feed
+		}
+		if m.state.exitFeedrate > feed {
+			vm.posStack[idx].state.exitFeedrate = feed
+		}
 	}
 }
 
@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"math"
+	"testing"
+)
+
+func circlePoint(cx, cy, r, angleDeg float64) (float64, float64) {
+	rad := angleDeg * math.Pi / 180
+	return cx + r*math.Cos(rad), cy + r*math.Sin(rad)
+}
+
+func linearPos(x, y float64) Position {
+	return Position{x: x, y: y, state: state{moveMode: moveModeLinear}}
+}
+
+func entrySet(x, y float64) Set {
+	return Set{Position{x: x, y: y}}
+}
+
+func TestTwoOptOrderFixesOutOfOrderTour(t *testing.T) {
+	sets := []Set{entrySet(0, 0), entrySet(2, 0), entrySet(1, 0), entrySet(3, 0)}
+
+	result := twoOptOrder(sets, 10)
+
+	if got := tourLength(result); math.Abs(got-3) > 1e-9 {
+		t.Fatalf("expected 2-opt to find the length-3 tour, got length %v", got)
+	}
+}
+
+func TestSimulatedAnnealingOrderReturnsBestSeenNotLastVisited(t *testing.T) {
+	sets := []Set{entrySet(0, 0), entrySet(1, 0), entrySet(2, 0), entrySet(3, 0)}
+	initialLen := tourLength(sets)
+
+	// A huge initial temperature guarantees the very first (worsening) candidate move
+	// is accepted; with only one iteration there's no chance to recover from it via
+	// the search itself - only tracking the best-seen tour separately can return the
+	// original, better ordering.
+	cfg := AnnealConfig{Iterations: 1, InitialTemp: 1e6, CoolingRate: 1}
+	result := simulatedAnnealingOrder(sets, cfg, newLCG(1))
+
+	if got := tourLength(result); math.Abs(got-initialLen) > 1e-9 {
+		t.Fatalf("expected the best-seen tour (length %v) to be returned, got length %v", initialLen, got)
+	}
+}
+
+func TestOptBogusMovesDoesNotMergeLinearIntoPrecedingArc(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			{x: 0, y: 0, state: state{moveMode: moveModeRapid}},
+			linearPos(10, 0),
+			{x: 15, y: 5, state: state{moveMode: moveModeCCWArc}},
+			linearPos(25, 5),
+		},
+	}
+
+	vm.OptBogusMoves(0.01)
+
+	var sawArc bool
+	for _, p := range vm.posStack {
+		if p.state.moveMode == moveModeCCWArc {
+			sawArc = true
+		}
+	}
+	if !sawArc {
+		t.Fatalf("expected the arc to survive OptBogusMoves, got %+v", vm.posStack)
+	}
+	if len(vm.posStack) != 3 {
+		t.Fatalf("expected the initial null rapid to be dropped and the other 3 moves to survive, got %d: %+v", len(vm.posStack), vm.posStack)
+	}
+}
+
+func TestOptArcsCollapsesMonotonicRun(t *testing.T) {
+	x0, y0 := circlePoint(0, 0, 5, 0)
+	x1, y1 := circlePoint(0, 0, 5, 30)
+	x2, y2 := circlePoint(0, 0, 5, 60)
+	x3, y3 := circlePoint(0, 0, 5, 90)
+
+	vm := &Machine{
+		posStack: []Position{
+			{x: x0, y: y0, state: state{moveMode: moveModeRapid}},
+			linearPos(x1, y1),
+			linearPos(x2, y2),
+			linearPos(x3, y3),
+		},
+	}
+
+	vm.OptArcs(1e-6)
+
+	if len(vm.posStack) != 2 {
+		t.Fatalf("expected the monotonic run to collapse to 1 arc after the anchor, got %d positions", len(vm.posStack))
+	}
+	if mode := vm.posStack[1].state.moveMode; mode != moveModeCCWArc {
+		t.Fatalf("expected a CCW arc, got move mode %v", mode)
+	}
+}
+
+func TestOptArcsRejectsNonMonotonicRun(t *testing.T) {
+	x0, y0 := circlePoint(0, 0, 5, 0)
+	x1, y1 := circlePoint(0, 0, 5, 30)
+	x2, y2 := circlePoint(0, 0, 5, 10) // backtracks - cocircular but not monotonic
+	x3, y3 := circlePoint(0, 0, 5, 60)
+
+	vm := &Machine{
+		posStack: []Position{
+			{x: x0, y: y0, state: state{moveMode: moveModeRapid}},
+			linearPos(x1, y1),
+			linearPos(x2, y2),
+			linearPos(x3, y3),
+		},
+	}
+
+	vm.OptArcs(1e-6)
+
+	if len(vm.posStack) != 4 {
+		t.Fatalf("expected the non-monotonic cocircular run to be left uncollapsed, got %d positions", len(vm.posStack))
+	}
+	for _, p := range vm.posStack[1:] {
+		if p.state.moveMode != moveModeLinear {
+			t.Fatalf("expected only linear moves, got move mode %v", p.state.moveMode)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package vm
+
+// How a peck retracts between plunges.
+type RetractMode int
+
+const (
+	RetractFull      RetractMode = iota // retract all the way to safety height
+	RetractChipBreak                    // short retract, just enough to break the chip
+)
+
+// Configures peck-drilling expansion.
+type PeckConfig struct {
+	PeckDepth     float64     // depth of each peck, in machine units
+	Dwell         float64     // dwell at the bottom of each peck, in seconds
+	RetractMode   RetractMode // full safety-height retract vs. short chip-break retract
+	AccelDistance float64     // clearance above the previous depth before the next plunge
+}
+
+// Scans posStack for linear Z-descent moves below Z0 - detected the same way
+// OptDrillSpeed identifies drills - and rewrites each into a peck sequence: rapid to
+// just above the previous depth, linear feed down by cfg.PeckDepth, dwell, retract per
+// cfg.RetractMode, repeated until the target depth is reached. This mirrors deep-hole
+// drilling cycles (G73/G83) and improves swarf clearing on deep holes.
+//
+// Interoperates with OptDrillSpeed: if a previous drill at (x,y) already reached a
+// known depth, pecking starts from that depth rather than from the surface.
+func (vm *Machine) ExpandPeckDrilling(cfg PeckConfig) {
+	var (
+		lastx, lasty, lastz float64
+		npos                = make([]Position, 0, len(vm.posStack))
+		drillDepths         = make(map[[2]float64]float64)
+	)
+
+	for _, m := range vm.posStack {
+		if isDescentMove(m, lastx, lasty, lastz) && m.z < 0 {
+			key := [2]float64{m.x, m.y}
+			known, hasKnown := drillDepths[key]
+
+			if hasKnown && m.z >= known {
+				// Already drilled at least this deep on a previous pass - the same
+				// way OptDrillSpeed's fastDrill handles pos.z >= depth - so there's
+				// nothing left to peck, just rapid straight to the requested depth.
+				rapid := m
+				rapid.state.moveMode = moveModeRapid
+				npos = append(npos, rapid)
+			} else {
+				startZ := lastz
+				if hasKnown && known < startZ {
+					// The actual current position is still lastz (from the preceding
+					// retract) - rapid down to the known depth before pecking from
+					// there, the same way OptDrillSpeed's fastDrill bridges to a
+					// previously-drilled depth.
+					bridge := m
+					bridge.z = known
+					bridge.state.moveMode = moveModeRapid
+					npos = append(npos, bridge)
+					startZ = known
+				}
+				npos = append(npos, vm.expandPeck(m, startZ, cfg)...)
+			}
+
+			if !hasKnown || m.z < known {
+				drillDepths[key] = m.z
+			}
+		} else {
+			npos = append(npos, m)
+		}
+		lastx, lasty, lastz = m.x, m.y, m.z
+	}
+
+	vm.posStack = npos
+}
+
+// Builds the peck sequence for a single plunge to target, starting from startZ.
+func (vm *Machine) expandPeck(target Position, startZ float64, cfg PeckConfig) []Position {
+	var out []Position
+	safetyHeight := vm.detectSafetyHeight()
+
+	currentZ := startZ
+	first := true
+	for currentZ > target.z {
+		peckTarget := currentZ - cfg.PeckDepth
+		if peckTarget < target.z {
+			peckTarget = target.z
+		}
+
+		if !first && cfg.RetractMode != RetractChipBreak {
+			// In chip-break mode the prior iteration's short retract already left the
+			// tool at currentZ+cfg.AccelDistance, so this would be a no-op rapid to
+			// the same point.
+			approach := target
+			approach.z = currentZ + cfg.AccelDistance
+			approach.state.moveMode = moveModeRapid
+			out = append(out, approach)
+		}
+		first = false
+
+		plunge := target
+		plunge.z = peckTarget
+		plunge.state.moveMode = moveModeLinear
+		out = append(out, plunge)
+
+		if cfg.Dwell > 0 {
+			dwell := plunge
+			dwell.state.dwell = cfg.Dwell
+			out = append(out, dwell)
+		}
+
+		if peckTarget > target.z {
+			retract := plunge
+			retract.state.moveMode = moveModeRapid
+			if cfg.RetractMode == RetractFull {
+				retract.z = safetyHeight
+			} else {
+				retract.z = peckTarget + cfg.AccelDistance
+			}
+			out = append(out, retract)
+		}
+
+		currentZ = peckTarget
+	}
+
+	return out
+}
+
+// Scans for the highest Z reached anywhere in posStack, same detection used by
+// SetSafetyHeight and OptRouteGrouping.
+func (vm *Machine) detectSafetyHeight() float64 {
+	var maxz float64
+	for _, m := range vm.posStack {
+		if m.z > maxz {
+			maxz = m.z
+		}
+	}
+	return maxz
+}
@@ -0,0 +1,106 @@
+package vm
+
+import "testing"
+
+func TestExpandPeckDrillingStepsDownInPecks(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+			{x: 0, y: 0, z: -10, state: state{moveMode: moveModeLinear, feedrate: 20}},
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+		},
+	}
+
+	cfg := PeckConfig{PeckDepth: 3, Dwell: 0.5, RetractMode: RetractChipBreak, AccelDistance: 1}
+	vm.ExpandPeckDrilling(cfg)
+
+	var deepest float64
+	var linearPlunges int
+	for _, p := range vm.posStack {
+		if p.state.moveMode == moveModeLinear {
+			linearPlunges++
+			if p.z < deepest {
+				deepest = p.z
+			}
+		}
+	}
+
+	if linearPlunges < 4 {
+		t.Fatalf("expected the plunge to be split into multiple pecks, got %d linear moves", linearPlunges)
+	}
+	if deepest != -10 {
+		t.Fatalf("expected the final peck to reach the target depth -10, got %v", deepest)
+	}
+}
+
+func TestExpandPeckDrillingBridgesToKnownDepthWithRapid(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+			{x: 0, y: 0, z: -10, state: state{moveMode: moveModeLinear, feedrate: 20}},
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+			{x: 0, y: 0, z: -20, state: state{moveMode: moveModeLinear, feedrate: 20}},
+		},
+	}
+
+	cfg := PeckConfig{PeckDepth: 3, Dwell: 0, RetractMode: RetractFull, AccelDistance: 1}
+	vm.ExpandPeckDrilling(cfg)
+
+	// The second hole's known depth is -10 (from the first hole). A rapid move to
+	// exactly that depth can only be the bridge our fix inserts before pecking resumes -
+	// every other move in this plan is either a linear plunge or a retract to the
+	// safety height 5 or a chip-break/approach height, never a rapid to -10 itself.
+	var rapidsToKnownDepth int
+	for _, p := range vm.posStack {
+		if p.state.moveMode == moveModeRapid && p.z == -10 {
+			rapidsToKnownDepth++
+		}
+	}
+	if rapidsToKnownDepth != 1 {
+		t.Fatalf("expected exactly one rapid bridge to the known depth -10, got %d", rapidsToKnownDepth)
+	}
+}
+
+func TestExpandPeckDrillingRedrillShallowerThanKnownDepthJustRapids(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+			{x: 0, y: 0, z: -10, state: state{moveMode: moveModeLinear, feedrate: 20}},
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+			{x: 0, y: 0, z: -5, state: state{moveMode: moveModeLinear, feedrate: 20}},
+		},
+	}
+
+	cfg := PeckConfig{PeckDepth: 3, Dwell: 0, RetractMode: RetractFull, AccelDistance: 1}
+	vm.ExpandPeckDrilling(cfg)
+
+	final := vm.posStack[len(vm.posStack)-1]
+	if final.z != -5 {
+		t.Fatalf("expected the final position to reach the requested depth -5, got %v", final.z)
+	}
+	if final.state.moveMode != moveModeRapid {
+		t.Fatalf("expected the redrill to a shallower already-reached depth to be a plain rapid, got move mode %v", final.state.moveMode)
+	}
+}
+
+func TestExpandPeckDrillingChipBreakSkipsRedundantApproach(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			{x: 0, y: 0, z: 5, state: state{moveMode: moveModeRapid}},
+			{x: 0, y: 0, z: -10, state: state{moveMode: moveModeLinear, feedrate: 20}},
+		},
+	}
+
+	cfg := PeckConfig{PeckDepth: 3, Dwell: 0, RetractMode: RetractChipBreak, AccelDistance: 1}
+	vm.ExpandPeckDrilling(cfg)
+
+	// In chip-break mode, a retract already leaves the tool at peckTarget+AccelDistance -
+	// the next iteration's approach move would rapid straight back to the same point.
+	for i := 1; i < len(vm.posStack); i++ {
+		prev, cur := vm.posStack[i-1], vm.posStack[i]
+		if prev.state.moveMode == moveModeRapid && cur.state.moveMode == moveModeRapid &&
+			prev.x == cur.x && prev.y == cur.y && prev.z == cur.z {
+			t.Fatalf("expected no redundant rapid-to-same-point between pecks, got %+v then %+v", prev, cur)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package vm
+
+// The kind of motion a Position represents.
+type moveMode int
+
+const (
+	moveModeRapid moveMode = iota
+	moveModeLinear
+	moveModeCWArc
+	moveModeCCWArc
+	moveModeToolChange
+)
+
+// VM state carried alongside a move: everything needed to know how to get there and
+// what the machine should be doing while it does.
+type state struct {
+	moveMode moveMode
+
+	feedrate       float64
+	entryFeedrate  float64 // planned entry speed, set by PlanTrajectory
+	cruiseFeedrate float64 // planned cruise speed, set by PlanTrajectory
+	exitFeedrate   float64 // planned exit speed, set by PlanTrajectory
+
+	spindleSpeed     float64
+	spindleEnabled   bool
+	spindleClockwise bool
+
+	dwell float64 // seconds to dwell at this position, 0 if none
+
+	tool int // active tool number
+}
+
+// A single point in the toolpath, plus the VM state to reach and hold there. Arc moves
+// (moveModeCWArc/moveModeCCWArc) additionally use i/j as the arc center, expressed as
+// an offset from the arc's starting point, matching G2/G3 IJ notation.
+type Position struct {
+	x, y, z float64
+	i, j    float64
+
+	state state
+}
+
+// The machine's toolpath and the geometric tolerance its optimization passes should
+// treat two coordinates as equal within.
+type Machine struct {
+	posStack  []Position
+	tolerance float64
+}
@@ -0,0 +1,175 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Binds a tool number to the parameters it should run under.
+type ToolSpec struct {
+	Tool            int // tool number, as used in an M6 Tn tool-change command
+	SpindleSpeed    float64
+	FeedrateCeiling float64 // passed to LimitFeedrate for this tool's moves
+	PlungeFeedrate  float64 // feedrate applied to this tool's Z-descent moves
+	SafetyHeight    float64 // height to retract to before a tool change
+	ToolChangeX     float64 // machine position to move to for the tool change
+	ToolChangeY     float64
+}
+
+// Splits posStack into one *Machine per distinct tool, in first-seen order, each
+// carrying only that tool's moves. Used to process or emit a multi-tool job one tool
+// at a time.
+func (vm *Machine) SplitByTool() []*Machine {
+	groups := make(map[int][]Position)
+	order := make([]int, 0)
+
+	for _, p := range vm.posStack {
+		t := p.state.tool
+		if _, ok := groups[t]; !ok {
+			order = append(order, t)
+		}
+		groups[t] = append(groups[t], p)
+	}
+
+	machines := make([]*Machine, 0, len(order))
+	for _, t := range order {
+		machines = append(machines, &Machine{posStack: groups[t], tolerance: vm.tolerance})
+	}
+	return machines
+}
+
+// Reorders posStack so all moves for a given tool are contiguous, and inserts a
+// tool-change sequence at each boundary: retract to the outgoing tool's safety height,
+// move to the incoming tool's tool-change position, emit an M6 Tn marker, then
+// re-establish spindle state for the incoming tool. Per-tool LimitFeedrate and plunge
+// feedrate are applied to each tool's slice before it's re-joined into posStack.
+//
+// Returns an error if a tool used in posStack has no matching ToolSpec.
+func (vm *Machine) MergeTools(tools []ToolSpec) error {
+	specByTool := make(map[int]ToolSpec, len(tools))
+	for _, t := range tools {
+		specByTool[t.Tool] = t
+	}
+
+	// Split posStack into contiguous same-tool runs first, since a tool can be used,
+	// switched away from, then switched back to later in the job (SplitByTool's own
+	// test relies on exactly this interleaving). Concatenating those runs directly
+	// would silently join non-adjacent regions with a raw feed move between wherever
+	// the earlier run ended and the later one began.
+	type toolRun struct {
+		tool      int
+		positions []Position
+	}
+	runs := make([]toolRun, 0)
+	for _, p := range vm.posStack {
+		t := p.state.tool
+		if n := len(runs); n > 0 && runs[n-1].tool == t {
+			runs[n-1].positions = append(runs[n-1].positions, p)
+		} else {
+			runs = append(runs, toolRun{tool: t, positions: []Position{p}})
+		}
+	}
+
+	groups := make(map[int][]Position)
+	order := make([]int, 0)
+	for _, run := range runs {
+		t := run.tool
+		spec, ok := specByTool[t]
+		if !ok {
+			return errors.New(fmt.Sprintf("no ToolSpec for tool %d", t))
+		}
+
+		if existing, seen := groups[t]; seen {
+			// bridgeWithinTool's descend move already lands exactly on
+			// run.positions[0], so only the rest of the run gets appended after it.
+			bridge := bridgeWithinTool(existing[len(existing)-1], run.positions[0], spec.SafetyHeight)
+			groups[t] = append(append(existing, bridge...), run.positions[1:]...)
+		} else {
+			order = append(order, t)
+			groups[t] = append([]Position{}, run.positions...)
+		}
+	}
+
+	newPos := make([]Position, 0, len(vm.posStack))
+	for i, t := range order {
+		spec, ok := specByTool[t]
+		if !ok {
+			return errors.New(fmt.Sprintf("no ToolSpec for tool %d", t))
+		}
+
+		segment := groups[t]
+
+		if i > 0 {
+			prevSpec := specByTool[order[i-1]]
+			newPos = append(newPos, toolChangeSequence(newPos[len(newPos)-1], prevSpec, spec)...)
+		}
+
+		applyPlungeFeedrate(segment, spec.PlungeFeedrate)
+
+		sub := &Machine{posStack: segment, tolerance: vm.tolerance}
+		sub.LimitFeedrate(spec.FeedrateCeiling)
+
+		for idx := range segment {
+			segment[idx].state.tool = t
+			segment[idx].state.spindleSpeed = spec.SpindleSpeed
+			segment[idx].state.spindleEnabled = true
+		}
+
+		newPos = append(newPos, segment...)
+	}
+
+	vm.posStack = newPos
+	return nil
+}
+
+// Builds the retract/travel/M6/spindle sequence inserted between two tools' moves.
+func toolChangeSequence(curPos Position, prevSpec, nextSpec ToolSpec) []Position {
+	retract := curPos
+	retract.z = prevSpec.SafetyHeight
+	retract.state.moveMode = moveModeRapid
+	retract.state.spindleEnabled = false
+
+	travel := retract
+	travel.x, travel.y = nextSpec.ToolChangeX, nextSpec.ToolChangeY
+
+	marker := travel
+	marker.state.moveMode = moveModeToolChange
+	marker.state.tool = nextSpec.Tool
+
+	spindleUp := marker
+	spindleUp.state.spindleSpeed = nextSpec.SpindleSpeed
+	spindleUp.state.spindleEnabled = true
+
+	return []Position{retract, travel, marker, spindleUp}
+}
+
+// Builds the retract/travel/descend sequence bridging two non-adjacent runs of the same
+// tool, so rejoining them doesn't feed straight through the stock between wherever the
+// earlier run ended and the later one begins. Unlike toolChangeSequence, there's no M6
+// marker or spindle change - it's still the same tool.
+func bridgeWithinTool(curPos, nextPos Position, safetyHeight float64) []Position {
+	retract := curPos
+	retract.z = safetyHeight
+	retract.state.moveMode = moveModeRapid
+
+	travel := retract
+	travel.x, travel.y = nextPos.x, nextPos.y
+
+	descend := travel
+	descend.z = nextPos.z
+	descend.state.moveMode = moveModeLinear
+
+	return []Position{retract, travel, descend}
+}
+
+// Sets the feedrate on every Z-descent linear move in the segment to plungeFeedrate,
+// using the same descent detection as OptDrillSpeed and ExpandPeckDrilling.
+func applyPlungeFeedrate(segment []Position, plungeFeedrate float64) {
+	var lastx, lasty, lastz float64
+	for idx, p := range segment {
+		if isDescentMove(p, lastx, lasty, lastz) {
+			segment[idx].state.feedrate = plungeFeedrate
+		}
+		lastx, lasty, lastz = p.x, p.y, p.z
+	}
+}
@@ -0,0 +1,118 @@
+package vm
+
+import "testing"
+
+func toolMove(x, y, z float64, tool int) Position {
+	return Position{x: x, y: y, z: z, state: state{moveMode: moveModeLinear, tool: tool}}
+}
+
+func TestSplitByToolGroupsByFirstSeenOrder(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			toolMove(0, 0, 0, 1),
+			toolMove(1, 0, 0, 2),
+			toolMove(2, 0, 0, 1),
+		},
+	}
+
+	machines := vm.SplitByTool()
+
+	if len(machines) != 2 {
+		t.Fatalf("expected 2 machines, got %d", len(machines))
+	}
+	if len(machines[0].posStack) != 2 || machines[0].posStack[0].state.tool != 1 {
+		t.Fatalf("expected the first machine to hold tool 1's 2 moves, got %+v", machines[0].posStack)
+	}
+	if len(machines[1].posStack) != 1 || machines[1].posStack[0].state.tool != 2 {
+		t.Fatalf("expected the second machine to hold tool 2's 1 move, got %+v", machines[1].posStack)
+	}
+}
+
+func TestMergeToolsInsertsToolChangeAndPlungeFeedrate(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			toolMove(0, 0, 5, 1),
+			toolMove(0, 0, -1, 1),
+			toolMove(5, 5, 5, 2),
+		},
+	}
+
+	tools := []ToolSpec{
+		{Tool: 1, SafetyHeight: 10, PlungeFeedrate: 50, FeedrateCeiling: 1000, ToolChangeX: 0, ToolChangeY: 0},
+		{Tool: 2, SafetyHeight: 10, PlungeFeedrate: 50, FeedrateCeiling: 1000, ToolChangeX: 5, ToolChangeY: 5},
+	}
+
+	if err := vm.MergeTools(tools); err != nil {
+		t.Fatalf("MergeTools returned an error: %v", err)
+	}
+
+	var sawToolChange bool
+	var plungeFeedrate float64
+	for _, p := range vm.posStack {
+		if p.state.moveMode == moveModeToolChange {
+			sawToolChange = true
+		}
+		if p.z == -1 {
+			plungeFeedrate = p.state.feedrate
+		}
+	}
+
+	if !sawToolChange {
+		t.Fatal("expected a tool-change move between tool 1's and tool 2's segments")
+	}
+	if plungeFeedrate != 50 {
+		t.Fatalf("expected the Z-descent move to carry the plunge feedrate 50, got %v", plungeFeedrate)
+	}
+}
+
+func TestMergeToolsBridgesInternalDiscontinuityWithinSameTool(t *testing.T) {
+	vm := &Machine{
+		posStack: []Position{
+			toolMove(0, 0, 0, 1),
+			toolMove(0, 0, -1, 1),
+			toolMove(50, 50, 5, 2),
+			toolMove(100, 100, 5, 1),
+		},
+	}
+
+	tools := []ToolSpec{
+		{Tool: 1, SafetyHeight: 10, PlungeFeedrate: 50, FeedrateCeiling: 1000, ToolChangeX: 0, ToolChangeY: 0},
+		{Tool: 2, SafetyHeight: 10, PlungeFeedrate: 50, FeedrateCeiling: 1000, ToolChangeX: 50, ToolChangeY: 50},
+	}
+
+	if err := vm.MergeTools(tools); err != nil {
+		t.Fatalf("MergeTools returned an error: %v", err)
+	}
+
+	// (100,100,5) should appear exactly once - the bridge's descend move already lands
+	// there, so the original position from tool 1's second region must not be appended
+	// again right behind it.
+	var matches []int
+	for i, p := range vm.posStack {
+		if p.x == 100 && p.y == 100 && p.z == 5 {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected (100,100,5) to appear exactly once, got %d times at indices %v: %+v", len(matches), matches, vm.posStack)
+	}
+
+	// And make sure whatever fed into it came from safety height rather than diving
+	// straight there from wherever the previous region left off.
+	i := matches[0]
+	if i == 0 {
+		t.Fatal("expected a bridge before tool 1's second region")
+	}
+	prev := vm.posStack[i-1]
+	if prev.z != 10 || prev.state.moveMode != moveModeRapid {
+		t.Fatalf("expected the move immediately before (100,100,5) to be a rapid at safety height 10, got %+v", prev)
+	}
+}
+
+func TestMergeToolsErrorsOnMissingSpec(t *testing.T) {
+	vm := &Machine{posStack: []Position{toolMove(0, 0, 0, 1)}}
+
+	if err := vm.MergeTools(nil); err == nil {
+		t.Fatal("expected an error when no ToolSpec matches the used tool")
+	}
+}
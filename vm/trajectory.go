@@ -0,0 +1,130 @@
+package vm
+
+import "math"
+
+// Motion limits and cornering behaviour used by PlanTrajectory. The velocity and
+// acceleration limits apply to the feed along each move's path, not to each axis
+// separately.
+type MachineLimits struct {
+	MaxVelocity       float64 // maximum feedrate, in machine units/min
+	MaxAcceleration   float64 // maximum acceleration, in machine units/min^2
+	JunctionDeviation float64 // Grbl/LinuxCNC-style cornering deviation, in machine units
+}
+
+// Post-processes posStack into a physically feasible motion plan given path
+// velocity/acceleration limits and a junction-deviation cornering parameter, in the
+// style of Grbl/LinuxCNC look-ahead planners.
+//
+// For every junction between two linear moves, the maximum speed the machine can carry
+// through the corner is derived from the turn angle theta (0 for a full reversal, pi for
+// a straight continuation - the supplementary angle of the angle between the two unit
+// vectors) and the junction-deviation limits.JunctionDeviation:
+//
+//	v_junction = sqrt(a * delta * sin(theta/2) / (1 - sin(theta/2)))
+//
+// This corner limit only bounds the ENTRY speed of the move following the corner - a
+// move's own cruise/exit speed is bounded by its own nominal feedrate (and
+// limits.MaxVelocity), so a long move after a sharp corner can still re-accelerate to
+// full feedrate before easing into whatever its own exit junction allows. A forward
+// pass then clamps each move's entry speed by v_exit^2 = v_entry^2 + 2*a*L, and a
+// reverse pass clamps exit speeds by v_entry^2 = v_exit^2 + 2*a*L, leaving each move
+// with an entry/cruise/exit feedrate that traces a trapezoidal (or, if the move is too
+// short to reach cruise speed, triangular) accel/cruise/decel profile.
+func (vm *Machine) PlanTrajectory(limits MachineLimits) {
+	n := len(vm.posStack)
+	if n == 0 {
+		return
+	}
+
+	nominal := make([]float64, n)    // this move's own cruise cap: its feedrate vs. MaxVelocity
+	entryLimit := make([]float64, n) // corner-speed limit for entering this move
+	length := make([]float64, n)
+
+	var lastx, lasty, lastz float64
+	var lastvecX, lastvecY, lastvecZ float64
+	haveLastVec := false
+
+	for idx, m := range vm.posStack {
+		dx, dy, dz := m.x-lastx, m.y-lasty, m.z-lastz
+		l := math.Sqrt(dx*dx + dy*dy + dz*dz)
+		length[idx] = l
+
+		nominal[idx] = math.Min(m.state.feedrate, limits.MaxVelocity)
+		entryLimit[idx] = nominal[idx]
+
+		if l > 0 && m.state.moveMode == moveModeLinear && haveLastVec {
+			vecX, vecY, vecZ := dx/l, dy/l, dz/l
+
+			dot := clampUnit(vecX*lastvecX + vecY*lastvecY + vecZ*lastvecZ)
+			theta := math.Acos(-dot) // supplementary angle: 0 = reversal, pi = straight through
+			sinHalf := math.Sin(theta / 2)
+
+			if sinHalf < 1 {
+				vJunction := math.Sqrt(limits.MaxAcceleration * limits.JunctionDeviation * sinHalf / (1 - sinHalf))
+				if vJunction < entryLimit[idx] {
+					entryLimit[idx] = vJunction
+				}
+			}
+
+			lastvecX, lastvecY, lastvecZ = vecX, vecY, vecZ
+			haveLastVec = true
+		} else if l > 0 && m.state.moveMode == moveModeLinear {
+			// First linear move of a chain - nothing to carry speed over from, so it
+			// starts from rest at its entry junction.
+			entryLimit[idx] = 0
+			lastvecX, lastvecY, lastvecZ = dx/l, dy/l, dz/l
+			haveLastVec = true
+		} else {
+			entryLimit[idx] = 0
+			haveLastVec = false
+		}
+
+		lastx, lasty, lastz = m.x, m.y, m.z
+	}
+
+	entry := make([]float64, n)
+	exit := make([]float64, n)
+
+	// Forward pass: clamp entry speeds by how fast we can accelerate from the previous
+	// move's exit, and clamp exit speeds by this move's own nominal cruise cap.
+	var prevExit float64
+	for idx := range vm.posStack {
+		entry[idx] = math.Min(entryLimit[idx], prevExit)
+		vExit := math.Sqrt(entry[idx]*entry[idx] + 2*limits.MaxAcceleration*length[idx])
+		exit[idx] = math.Min(vExit, nominal[idx])
+		prevExit = exit[idx]
+	}
+
+	// Reverse pass: clamp exit speeds by the next move's planned entry speed, and
+	// entry speeds by how fast we can decelerate into that exit speed.
+	for idx := n - 1; idx >= 0; idx-- {
+		if idx == n-1 {
+			exit[idx] = math.Min(exit[idx], 0)
+		} else {
+			exit[idx] = math.Min(exit[idx], entry[idx+1])
+		}
+		vEntry := math.Sqrt(exit[idx]*exit[idx] + 2*limits.MaxAcceleration*length[idx])
+		entry[idx] = math.Min(entry[idx], vEntry)
+	}
+
+	for idx := range vm.posStack {
+		// Peak speed reachable by accelerating from entry and decelerating to exit within
+		// the move's length; below the nominal cap, the profile is triangular.
+		peak := math.Sqrt((entry[idx]*entry[idx] + exit[idx]*exit[idx] + 2*limits.MaxAcceleration*length[idx]) / 2)
+		vm.posStack[idx].state.entryFeedrate = entry[idx]
+		vm.posStack[idx].state.cruiseFeedrate = math.Min(nominal[idx], peak)
+		vm.posStack[idx].state.exitFeedrate = exit[idx]
+	}
+}
+
+// Clamps a dot product of two unit vectors into [-1, 1] to guard against math.Acos(NaN)
+// from floating-point overshoot.
+func clampUnit(v float64) float64 {
+	if v > 1 {
+		return 1
+	}
+	if v < -1 {
+		return -1
+	}
+	return v
+}
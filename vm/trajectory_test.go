@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlanTrajectoryReaccelleratesAfterSharpCorner(t *testing.T) {
+	feed := 100.0
+	limits := MachineLimits{MaxVelocity: feed, MaxAcceleration: 50, JunctionDeviation: 0.01}
+
+	vm := &Machine{
+		tolerance: 1e-6,
+		posStack: []Position{
+			{x: 0, y: 0, z: 0, state: state{moveMode: moveModeRapid}},
+			{x: 10, y: 0, z: 0, state: state{moveMode: moveModeLinear, feedrate: feed}},
+			// Sharp 90-degree corner into a long block.
+			{x: 10, y: -1000, z: 0, state: state{moveMode: moveModeLinear, feedrate: feed}},
+			// Straight continuation - a gentle exit junction for the long block above, and
+			// long enough (100 = feed^2 / (2*accel)) to come to rest from the full feedrate.
+			{x: 10, y: -1100, z: 0, state: state{moveMode: moveModeLinear, feedrate: feed}},
+		},
+	}
+
+	vm.PlanTrajectory(limits)
+
+	longBlock := vm.posStack[2].state
+	if longBlock.entryFeedrate >= feed/2 {
+		t.Fatalf("expected the sharp-corner entry speed to stay restricted, got %v", longBlock.entryFeedrate)
+	}
+	if math.Abs(longBlock.exitFeedrate-feed) > 1e-6 {
+		t.Fatalf("expected the long block to re-accelerate to the nominal feedrate %v before its gentle exit, got %v", feed, longBlock.exitFeedrate)
+	}
+	if math.Abs(longBlock.cruiseFeedrate-feed) > 1e-6 {
+		t.Fatalf("expected the long block's cruise cap to be its own nominal feedrate %v, got %v", feed, longBlock.cruiseFeedrate)
+	}
+}